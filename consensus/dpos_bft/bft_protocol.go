@@ -15,23 +15,48 @@ import (
 	"bytes"
 )
 
+// errBeaconRoundMismatch and errElectionLost guard the leader-election
+// check: a PRE_PREPARE is only honored if it was seeded by the beacon
+// round this height actually uses and its author's proof shows a win.
+var (
+	errBeaconRoundMismatch = errors.New("election proof uses the wrong beacon round for this height")
+	errElectionLost        = errors.New("author did not win this round's leader election")
+	errStaleView           = errors.New("message belongs to a view this round has already moved past")
+)
+
 var (
 	errPeerIdNotFound   = errors.New("invalid bp: it's peer ID is not found in selected BP set")
 	errUnknownType      = errors.New("unknown message type")
 	errDigestNotMatch   = errors.New("digest is invalid")
 	errSignatureInvalid = errors.New("signature is invalid")
 	errReceiptNotMatch  = errors.New("receipt is not match the block header receiptHash")
+	errNotBP            = errors.New("local node is not the BP of this round")
+	errPrePrepareExist  = errors.New("duplicate PRE_PREPARE for this round")
+	errRoundNotFound    = errors.New("no PRE_PREPARE seen yet for this round")
+	errNoQuorumCert     = errors.New("blockPool has no quorum cert recorded for the selected head")
 
 	loopReadBlockGap     = 500 * time.Millisecond
 	loopReadBlockTimeout = 10 * time.Second
 )
 
+// QuorumCert bundles the >=2/3 unique COMMIT signatures collected for a
+// round, so the finalized block can carry proof that it was actually
+// agreed on.
+type QuorumCert struct {
+	SeqNo      uint64
+	Digest     []byte
+	Signatures []*msg.ConsensusMsg
+}
+
 // Type implements the `Protocol` interface, and returns the message type of consensus engine
 func (eg *Engine) Type() string {
 	return common.CONSENSUS_MSG
 }
 
-// Run implements the `Protocol` interface, and handle the message received from p2p layer
+// Run implements the `Protocol` interface, and handle the message received
+// from p2p layer. BP-set membership is checked for every message type;
+// PRE_PREPARE additionally goes through checkElection so a membership
+// check alone can no longer let a BP unilaterally drive the round.
 func (eg *Engine) Run(pid peer.ID, message *pb.Message) error {
 	consensusMsg := msg.ConsensusMsg{}
 	err := proto.Unmarshal(message.Data, &consensusMsg)
@@ -52,10 +77,16 @@ func (eg *Engine) Run(pid peer.ID, message *pb.Message) error {
 	}
 
 	switch consensusMsg.Type {
+	case PRE_PREPARE:
+		return eg.prePrepare(pid, &consensusMsg)
 	case PRE_COMMIT:
-		return eg.preCommit(&consensusMsg)
+		return eg.preCommit(pid, &consensusMsg)
 	case COMMIT:
-		return eg.commit(&consensusMsg)
+		return eg.commit(pid, &consensusMsg)
+	case VIEW_CHANGE:
+		return eg.handleViewChange(pid, &consensusMsg)
+	case NEW_VIEW:
+		return eg.handleNewView(pid, &consensusMsg)
 	default:
 		log.Errorf("error: %s", errUnknownType)
 		return errUnknownType
@@ -84,43 +115,144 @@ func (eg *Engine) fetchBlockLoop(seqNo uint64) (*types.Block, error) {
 	}
 }
 
-// startBFT kicks off the bft process
-// 1. retrived from block_pool (block have been validated), and multicast PRE_COMMIT
+// startBFT kicks off the bft process for the local BP
+// 1. retrived from block_pool (block have been validated)
+// 2. prove this round's leader election against the current beacon entry
+// 3. sign the block header and multicast PRE_PREPARE
 func (eg *Engine) startBFT() error {
 	block, err := eg.fetchBlockLoop(eg.SeqNo())
 	if err != nil {
 		return err
 	}
-	hash := block.Hash()
-	digest := common.Sha256(hash.Bytes()).Bytes()
-	sign, err := eg.Self().PrivKey().Sign(digest)
+
+	beaconEntry, err := eg.beacon.EntryForHeight(eg.SeqNo())
 	if err != nil {
-		log.Errorf("failed to sign PRE_COMMIT message, err:%s", err)
+		log.Errorf("failed to fetch beacon entry for round #%d, err:%s", eg.SeqNo(), err)
 		return err
 	}
-	pubKey, err := eg.Self().PubKey().Bytes()
+
+	electionProof, err := computeElectionProof(eg.Self().PrivKey(), beaconEntry.Data, eg.SeqNo())
+	if err != nil {
+		log.Errorf("failed to compute election proof, err:%s", err)
+		return err
+	}
+	selfPubKey, err := eg.Self().PubKey().Bytes()
 	if err != nil {
 		log.Errorf("failed to convert pubkey to bytes, err:%s", err)
 		return err
 	}
+	winCount := computeWinCount(electionProof, eg.stakeOf(selfPubKey), eg.totalStake())
+	if winCount == 0 {
+		return errElectionLost
+	}
+
+	digest, pubKey, sign, err := eg.computeConsensusInfo(block)
+	if err != nil {
+		return err
+	}
+
+	state := eg.statePool.getOrCreate(eg.SeqNo())
+	prePrepareMsg := &msg.ConsensusMsg{
+		Type:          PRE_PREPARE,
+		SeqNo:         eg.SeqNo(),
+		View:          state.View,
+		Digest:        digest,
+		PubKey:        pubKey,
+		Signature:     sign,
+		Header:        block.Header().Bytes(),
+		BeaconRound:   beaconEntry.Round,
+		ElectionProof: electionProof,
+		WinCount:      winCount,
+	}
+	if !state.setPrePrepare(prePrepareMsg) {
+		return errPrePrepareExist
+	}
+	eg.watchRound(eg.SeqNo(), state.View)
+
+	return eg.multicastConsensus(prePrepareMsg)
+}
+
+// prePrepare receives the PRE_PREPARE broadcast from the round's elected
+// BP and checks the author's election proof before handing off to
+// acceptPrePrepare. A plain PRE_PREPARE's only source of legitimacy is
+// having won the round's sortition, so this gate is mandatory here.
+// NEW_VIEW is legitimate a different way (a 2/3 VIEW_CHANGE quorum plus
+// deterministic round-robin selection) and goes straight to
+// acceptPrePrepare instead, see handleNewView.
+func (eg *Engine) prePrepare(pid peer.ID, message *msg.ConsensusMsg) error {
+	if err := eg.checkElection(message); err != nil {
+		log.Errorf("Check PRE_PREPARE election proof not pass, err:%s", err)
+		return err
+	}
+	return eg.acceptPrePrepare(pid, message)
+}
+
+// acceptPrePrepare verifies message against the block fetched from
+// blockPool and, if it checks out, moves the round to PRE_COMMIT by
+// signing and multicasting its own PRE_COMMIT vote. It does not itself
+// check the author's election proof, since NEW_VIEW reaches here too and
+// its election proof is not checked.
+func (eg *Engine) acceptPrePrepare(pid peer.ID, message *msg.ConsensusMsg) error {
+	block, err := eg.fetchBlockLoop(message.SeqNo)
+	if err != nil {
+		log.Errorf("err: %s", err)
+		return err
+	}
+
+	if err := eg.checkPreCommit(block, message); err != nil {
+		log.Errorf("Check PRE_PREPARE not pass, err:%s", err)
+		return err
+	}
+
+	state := eg.statePool.getOrCreate(message.SeqNo)
+	if !state.matchesView(message.View) {
+		return errStaleView
+	}
+	if !state.setPrePrepare(message) {
+		return errPrePrepareExist
+	}
+	eg.watchRound(message.SeqNo, message.View)
+
+	digest, pubKey, sign, err := eg.computeConsensusInfo(block)
+	if err != nil {
+		return err
+	}
+
 	return eg.multicastConsensus(&msg.ConsensusMsg{
 		Type:      PRE_COMMIT,
-		SeqNo:     eg.SeqNo(),
+		SeqNo:     message.SeqNo,
+		View:      message.View,
 		Digest:    digest,
 		PubKey:    pubKey,
 		Signature: sign,
 	})
 }
 
-// preCommit receives pre_commit message and decide whether to process the block
-// and multicast COMMIT
+// preCommit receives a PRE_COMMIT vote, appends it to the engine's
+// ConsensusMessageLog (which rejects duplicate or unverifiable votes),
+// and once >=2/3 unique BPs have voted moves on to COMMIT by signing and
+// multicasting its own COMMIT vote.
 // 1. process block
 // 2. if valid, multicast COMMIT
-func (eg *Engine) preCommit(message *msg.ConsensusMsg) error {
-	eg.preCommitVotes += 1
-	if eg.preCommitVotes <= eg.config.RoundSize*2/3 {
+func (eg *Engine) preCommit(pid peer.ID, message *msg.ConsensusMsg) error {
+	state, ok := eg.statePool.get(message.SeqNo)
+	if !ok {
+		return errRoundNotFound
+	}
+	if !state.matchesView(message.View) {
+		return errStaleView
+	}
+
+	if _, err := eg.msgLog.Add(message); err != nil {
+		log.Errorf("failed to record PRE_COMMIT vote, err:%s", err)
+		return err
+	}
+
+	count := eg.msgLog.Count(message.SeqNo, message.Digest, PRE_COMMIT)
+	if count <= eg.config.RoundSize*2/3 {
 		return nil
 	}
+
 	block, err := eg.fetchBlockLoop(message.SeqNo)
 	if err != nil {
 		log.Errorf("err: %s", err)
@@ -141,6 +273,15 @@ func (eg *Engine) preCommit(message *msg.ConsensusMsg) error {
 		}
 	}
 
+	// Only latch the round into PhaseCommit once the checks above have
+	// actually passed, so a failure here leaves the phase at
+	// PhasePreCommit: a later PRE_COMMIT crossing the same threshold can
+	// still retry, and watchRound's "phase < PhaseCommit" safety net can
+	// still fire a view change instead of treating the round as done.
+	if !state.advance(PhaseCommit) {
+		return nil
+	}
+
 	digest, pubKey, sign, err := eg.computeConsensusInfo(block)
 	if err != nil {
 		return err
@@ -148,20 +289,83 @@ func (eg *Engine) preCommit(message *msg.ConsensusMsg) error {
 
 	return eg.multicastConsensus(&msg.ConsensusMsg{
 		Type:      COMMIT,
-		SeqNo:     eg.SeqNo(),
+		SeqNo:     message.SeqNo,
+		View:      message.View,
 		Digest:    digest,
 		PubKey:    pubKey,
 		Signature: sign,
 	})
 }
 
-// commit receives commit message and decide whether to commit the block
-func (eg *Engine) commit(message *msg.ConsensusMsg) error {
-	eg.commitVotes += 1
-	if eg.commitVotes <= eg.config.RoundSize*2/3 {
+// commit receives a COMMIT vote, appends it to the engine's
+// ConsensusMessageLog, and once >=2/3 unique BPs have voted finalizes the
+// block exactly once.
+func (eg *Engine) commit(pid peer.ID, message *msg.ConsensusMsg) error {
+	state, ok := eg.statePool.get(message.SeqNo)
+	if !ok {
+		return errRoundNotFound
+	}
+	if !state.matchesView(message.View) {
+		return errStaleView
+	}
+
+	if _, err := eg.msgLog.Add(message); err != nil {
+		log.Errorf("failed to record COMMIT vote, err:%s", err)
+		return err
+	}
+
+	count := eg.msgLog.Count(message.SeqNo, message.Digest, COMMIT)
+	if count <= eg.config.RoundSize*2/3 {
+		return nil
+	}
+	if !state.advance(PhaseCommitted) {
 		return nil
 	}
 
+	if err := eg.checkCommit(state, message.Digest); err != nil {
+		log.Errorf("Check COMMIT not pass, err:%s", err)
+		return err
+	}
+
+	block, err := eg.fetchBlockLoop(message.SeqNo)
+	if err != nil {
+		log.Errorf("err: %s", err)
+		return err
+	}
+
+	quorumCert := &QuorumCert{
+		SeqNo:      message.SeqNo,
+		Digest:     message.Digest,
+		Signatures: eg.msgLog.Signatures(message.SeqNo, message.Digest, COMMIT),
+	}
+
+	prePrepare := state.PrePrepareMsg
+	eg.statePool.delete(message.SeqNo)
+	return eg.finalize(block, quorumCert, prePrepare)
+}
+
+// finalize registers the committed block as an accepted candidate for its
+// height, together with the quorum certificate that actually attests to
+// it, alongside whatever else committed there (a rotating BP set can let
+// two BPs each commit a block for the same height across a partition or
+// view change). It then writes blockPool's chosen head for that height to
+// the chain paired with *that block's own* quorum certificate - head can
+// be a different candidate than block once more than one has been
+// accepted at this height, and quorumCert's signatures only attest to
+// block, so the two must never be written to chain as a mismatched pair.
+func (eg *Engine) finalize(block *types.Block, quorumCert *QuorumCert, prePrepare *msg.ConsensusMsg) error {
+	eg.blockPool.AddAcceptedBlock(block, prePrepare.WinCount, common.Sha256(prePrepare.ElectionProof).Bytes(), quorumCert)
+
+	head, err := eg.SelectHead(quorumCert.SeqNo)
+	if err != nil {
+		log.Errorf("failed to select head for round #%d, err:%s", quorumCert.SeqNo, err)
+		return err
+	}
+	headCert := eg.blockPool.QuorumCertOf(head)
+	if headCert == nil {
+		return errNoQuorumCert
+	}
+	return eg.chain.WriteBlockWithQuorumCert(head, headCert)
 }
 
 func (eg *Engine) multicastConsensus(message *msg.ConsensusMsg) error {
@@ -210,6 +414,63 @@ func (eg *Engine) checkPreCommit(block *types.Block, message *msg.ConsensusMsg)
 	return nil
 }
 
+// checkElection verifies that message's election proof was seeded by the
+// beacon round this height actually uses, was produced by the holder of
+// PubKey, and clears the stake-weighted winning threshold it claims.
+// PRE_PREPAREs that fail this can only have come from a BP that did not
+// actually win the round.
+func (eg *Engine) checkElection(message *msg.ConsensusMsg) error {
+	beaconEntry, err := eg.beacon.EntryForHeight(message.SeqNo)
+	if err != nil {
+		log.Errorf("failed to fetch beacon entry for round #%d, err:%s", message.SeqNo, err)
+		return err
+	}
+	if beaconEntry.Round != message.BeaconRound {
+		return errBeaconRoundMismatch
+	}
+
+	pubKey, err := crypto.UnmarshalPublicKey(message.PubKey)
+	if err != nil {
+		log.Errorf("invalid public key, err:%s", err)
+		return err
+	}
+
+	equal, err := verifyElectionProof(pubKey, beaconEntry.Data, message.SeqNo, message.ElectionProof)
+	if err != nil {
+		log.Errorf("error occurs when verify election proof, err:%s", err)
+		return err
+	}
+	if !equal {
+		return errSignatureInvalid
+	}
+
+	stake := eg.stakeOf(message.PubKey)
+	if message.WinCount == 0 || computeWinCount(message.ElectionProof, stake, eg.totalStake()) != message.WinCount {
+		return errElectionLost
+	}
+	return nil
+}
+
+// totalStake sums the stake weight of every BP in the current set.
+func (eg *Engine) totalStake() uint64 {
+	var total uint64
+	for _, bp := range eg.bps.getBPs() {
+		total += bp.stake
+	}
+	return total
+}
+
+// stakeOf returns the stake weight of the BP identified by pubKey, or 0
+// if pubKey does not belong to any BP in the current set.
+func (eg *Engine) stakeOf(pubKey []byte) uint64 {
+	for _, bp := range eg.bps.getBPs() {
+		if bytes.Compare(bp.pubKey, pubKey) == 0 {
+			return bp.stake
+		}
+	}
+	return 0
+}
+
 // checkReceipts checks the receipts of the block
 func (eg *Engine) checkReceipts(block *types.Block, receipts types.Receipts) error {
 	root := receipts.Hash()
@@ -219,9 +480,17 @@ func (eg *Engine) checkReceipts(block *types.Block, receipts types.Receipts) err
 	return nil
 }
 
-// checkCommit checks the COMMIT message is valid or not
-func (eg *Engine) checkCommit() error {
-
+// checkCommit checks that the round's COMMIT phase reached quorum against
+// the same digest the PRE_PREPARE proposed, so a BP cannot sneak a commit
+// through for a different block than the one that was pre-prepared.
+func (eg *Engine) checkCommit(state *ConsensusState, digest []byte) error {
+	if state.PrePrepareMsg == nil {
+		return errRoundNotFound
+	}
+	if bytes.Compare(digest, state.PrePrepareMsg.Digest) != 0 {
+		return errDigestNotMatch
+	}
+	return nil
 }
 
 func (eg *Engine) computeConsensusInfo(block *types.Block) (digest []byte, pubKey []byte, sign []byte, err error) {
@@ -0,0 +1,55 @@
+package dpos_bft
+
+import (
+	"testing"
+
+	"tinychain/common"
+)
+
+func TestComputeWinCount_NoStakeNeverWins(t *testing.T) {
+	proof := common.Sha256([]byte("proof")).Bytes()
+
+	if got := computeWinCount(proof, 0, 100); got != 0 {
+		t.Fatalf("computeWinCount with zero stake = %d, want 0", got)
+	}
+	if got := computeWinCount(proof, 10, 0); got != 0 {
+		t.Fatalf("computeWinCount with zero totalStake = %d, want 0", got)
+	}
+}
+
+func TestComputeWinCount_FullStakeAlwaysWins(t *testing.T) {
+	// A proof whose hash can only fall below a threshold computed from
+	// stake == totalStake; the draw space is [0, threshold) == [0, space),
+	// so every draw must win.
+	for i := 0; i < 8; i++ {
+		proof := common.Sha256([]byte{byte(i)}).Bytes()
+		if got := computeWinCount(proof, 100, 100); got != 1 {
+			t.Fatalf("computeWinCount with stake == totalStake = %d, want 1 (proof index %d)", got, i)
+		}
+	}
+}
+
+func TestComputeWinCount_IsDeterministic(t *testing.T) {
+	proof := common.Sha256([]byte("deterministic-proof")).Bytes()
+
+	first := computeWinCount(proof, 7, 50)
+	for i := 0; i < 10; i++ {
+		if got := computeWinCount(proof, 7, 50); got != first {
+			t.Fatalf("computeWinCount is not deterministic: got %d, want %d on call %d", got, first, i)
+		}
+	}
+}
+
+func TestComputeWinCount_HigherStakeNeverLosesAWinLowerStakeHas(t *testing.T) {
+	// For a fixed proof, the threshold scales monotonically with stake, so
+	// if a lower stake already wins, the same proof must also win at a
+	// higher stake.
+	proof := common.Sha256([]byte("monotonic-proof")).Bytes()
+	const totalStake = 1000
+
+	lowWon := computeWinCount(proof, 1, totalStake) == 1
+	highWon := computeWinCount(proof, 500, totalStake) == 1
+	if lowWon && !highWon {
+		t.Fatal("a proof that wins at low stake must also win at higher stake under the same total")
+	}
+}
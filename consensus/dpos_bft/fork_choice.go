@@ -0,0 +1,92 @@
+package dpos_bft
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"tinychain/core/types"
+)
+
+var errNoCandidates = errors.New("blockPool has no accepted candidates for this height")
+
+// SelectHead chooses the canonical block for seqNo among every candidate
+// blockPool has accepted at that height. A rotating BP set means two BPs
+// can each reach quorum on a different block for the same height (a
+// network partition, a view change mid-round), so commit alone no longer
+// implies a single winner. SelectHead applies the heaviest-chain rule:
+// weight(block) = sum(electionProof.winCount) accumulated across the
+// chain back to genesis, ties broken by the lower H(ElectionProof) of
+// the candidate's own PRE_PREPARE.
+func (eg *Engine) SelectHead(seqNo uint64) (*types.Block, error) {
+	candidates := eg.blockPool.GetAcceptedBlocks(seqNo)
+	if len(candidates) == 0 {
+		return nil, errNoCandidates
+	}
+
+	weights := make([]*big.Int, len(candidates))
+	proofHashes := make([][]byte, len(candidates))
+	for i, candidate := range candidates {
+		weights[i] = eg.chainWeight(candidate)
+		proofHashes[i] = eg.blockPool.ElectionProofHashOf(candidate)
+	}
+
+	return candidates[pickHeaviest(weights, proofHashes)], nil
+}
+
+// pickHeaviest is the pure comparator behind SelectHead: given each
+// candidate's chain weight and election-proof hash (by matching index),
+// it returns the index of the heaviest candidate, ties broken by the
+// lower proof hash. Split out from SelectHead so the tie-break and
+// weight-comparison logic can be tested without a live blockPool.
+func pickHeaviest(weights []*big.Int, proofHashes [][]byte) int {
+	head := 0
+	for i := 1; i < len(weights); i++ {
+		switch weights[i].Cmp(weights[head]) {
+		case 1:
+			head = i
+		case 0:
+			if bytes.Compare(proofHashes[i], proofHashes[head]) < 0 {
+				head = i
+			}
+		}
+	}
+	return head
+}
+
+// chainWeight sums the election winCount of block and every ancestor back
+// to genesis, the heaviest-chain analogue of cumulative difficulty in a
+// PoW chain.
+func (eg *Engine) chainWeight(block *types.Block) *big.Int {
+	weight := new(big.Int)
+	for b := block; b != nil; b = eg.blockPool.GetParent(b) {
+		weight.Add(weight, new(big.Int).SetUint64(eg.blockPool.WinCountOf(b)))
+	}
+	return weight
+}
+
+// PruneAcceptedBlocks runs at the start of every new round (see
+// ExpectRound) to resolve the previous height's fork, if any: it selects
+// the canonical head via SelectHead, drops every losing candidate from
+// blockPool, and returns their transactions to the mempool so they can be
+// re-included in a future block instead of being silently lost.
+func (eg *Engine) PruneAcceptedBlocks(seqNo uint64) error {
+	candidates := eg.blockPool.GetAcceptedBlocks(seqNo)
+	if len(candidates) <= 1 {
+		return nil
+	}
+
+	head, err := eg.SelectHead(seqNo)
+	if err != nil {
+		return err
+	}
+
+	for _, candidate := range candidates {
+		if bytes.Compare(candidate.Hash().Bytes(), head.Hash().Bytes()) == 0 {
+			continue
+		}
+		eg.blockPool.DropAcceptedBlock(seqNo, candidate)
+		eg.mempool.Requeue(candidate.Transactions())
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package dpos_bft
+
+import (
+	"math/big"
+	"testing"
+)
+
+func bigInts(vals ...int64) []*big.Int {
+	out := make([]*big.Int, len(vals))
+	for i, v := range vals {
+		out[i] = big.NewInt(v)
+	}
+	return out
+}
+
+func TestPickHeaviest_HeaviestWeightWins(t *testing.T) {
+	weights := bigInts(5, 9, 3)
+	proofHashes := [][]byte{{0x01}, {0x02}, {0x03}}
+
+	if got := pickHeaviest(weights, proofHashes); got != 1 {
+		t.Fatalf("pickHeaviest = %d, want 1 (the heaviest candidate)", got)
+	}
+}
+
+func TestPickHeaviest_TieBreaksOnLowerProofHash(t *testing.T) {
+	weights := bigInts(5, 5, 5)
+	proofHashes := [][]byte{{0x03}, {0x01}, {0x02}}
+
+	if got := pickHeaviest(weights, proofHashes); got != 1 {
+		t.Fatalf("pickHeaviest = %d, want 1 (lowest proof hash among equal weights)", got)
+	}
+}
+
+func TestPickHeaviest_SingleCandidate(t *testing.T) {
+	weights := bigInts(1)
+	proofHashes := [][]byte{{0xff}}
+
+	if got := pickHeaviest(weights, proofHashes); got != 0 {
+		t.Fatalf("pickHeaviest = %d, want 0", got)
+	}
+}
+
+func TestPickHeaviest_FirstCandidateKeptOnStrictLoss(t *testing.T) {
+	weights := bigInts(10, 1)
+	proofHashes := [][]byte{{0x01}, {0x00}}
+
+	if got := pickHeaviest(weights, proofHashes); got != 0 {
+		t.Fatalf("pickHeaviest = %d, want 0 (higher weight beats a lower proof hash)", got)
+	}
+}
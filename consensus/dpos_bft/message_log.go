@@ -0,0 +1,106 @@
+package dpos_bft
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-crypto"
+	"github.com/libp2p/go-libp2p-peer"
+	msg "tinychain/consensus/dpos_bft/message"
+)
+
+// msgLogKey identifies a single vote: the round it belongs to, the digest
+// it votes for, its phase, and the peer.ID derived from the signer's
+// PubKey (not the p2p-layer source address), so a vote can only ever be
+// counted once no matter how many times its author rebroadcasts it.
+type msgLogKey struct {
+	seqNo  uint64
+	digest string
+	typ    msg.MsgType
+	peerID peer.ID
+}
+
+// ConsensusMessageLog is an append-only, signature-verified record of
+// every PRE_COMMIT/COMMIT vote seen. It replaces raw per-round counters:
+// a vote is only ever recorded once per (seqNo, digest, type, signer), so
+// a BP resending its own message can never push a count past quorum.
+type ConsensusMessageLog struct {
+	mu      sync.RWMutex
+	entries map[msgLogKey]*msg.ConsensusMsg
+}
+
+// NewConsensusMessageLog creates an empty log.
+func NewConsensusMessageLog() *ConsensusMessageLog {
+	return &ConsensusMessageLog{
+		entries: make(map[msgLogKey]*msg.ConsensusMsg),
+	}
+}
+
+// Add verifies message's signature against the PubKey it carries, derives
+// the peer.ID of its signer, and records the vote. It returns false
+// (without error) if this exact signer has already voted for this round,
+// digest and phase.
+func (l *ConsensusMessageLog) Add(message *msg.ConsensusMsg) (bool, error) {
+	pubKey, err := crypto.UnmarshalPublicKey(message.PubKey)
+	if err != nil {
+		log.Errorf("invalid public key, err:%s", err)
+		return false, err
+	}
+
+	equal, err := pubKey.Verify(message.Digest, message.Signature)
+	if err != nil {
+		log.Errorf("error occurs when verify signature, err:%s", err)
+		return false, err
+	}
+	if !equal {
+		return false, errSignatureInvalid
+	}
+
+	pid, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		log.Errorf("failed to derive peer.ID from pubkey, err:%s", err)
+		return false, err
+	}
+
+	key := msgLogKey{
+		seqNo:  message.SeqNo,
+		digest: string(message.Digest),
+		typ:    message.Type,
+		peerID: pid,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, exists := l.entries[key]; exists {
+		return false, nil
+	}
+	l.entries[key] = message
+	return true, nil
+}
+
+// Count returns the number of unique signers that have voted for
+// (seqNo, digest, typ).
+func (l *ConsensusMessageLog) Count(seqNo uint64, digest []byte, typ msg.MsgType) int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	count := 0
+	for key := range l.entries {
+		if key.seqNo == seqNo && key.typ == typ && key.digest == string(digest) {
+			count++
+		}
+	}
+	return count
+}
+
+// Signatures returns the accumulated {PubKey, Signature} set for
+// (seqNo, digest, typ), used to build a block's quorum certificate.
+func (l *ConsensusMessageLog) Signatures(seqNo uint64, digest []byte, typ msg.MsgType) []*msg.ConsensusMsg {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var signatures []*msg.ConsensusMsg
+	for key, message := range l.entries {
+		if key.seqNo == seqNo && key.typ == typ && key.digest == string(digest) {
+			signatures = append(signatures, message)
+		}
+	}
+	return signatures
+}
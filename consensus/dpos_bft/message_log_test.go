@@ -0,0 +1,100 @@
+package dpos_bft
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-crypto"
+	msg "tinychain/consensus/dpos_bft/message"
+)
+
+// signedVote builds a COMMIT vote for (seqNo, digest) signed by a freshly
+// generated keypair, so each call produces a distinct signer.
+func signedVote(t *testing.T, seqNo uint64, digest []byte) *msg.ConsensusMsg {
+	t.Helper()
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate keypair: %s", err)
+	}
+	pubBytes, err := pub.Bytes()
+	if err != nil {
+		t.Fatalf("failed to marshal pubkey: %s", err)
+	}
+	sign, err := priv.Sign(digest)
+	if err != nil {
+		t.Fatalf("failed to sign digest: %s", err)
+	}
+	return &msg.ConsensusMsg{
+		Type:      COMMIT,
+		SeqNo:     seqNo,
+		Digest:    digest,
+		PubKey:    pubBytes,
+		Signature: sign,
+	}
+}
+
+func TestConsensusMessageLog_AddDedupesBySigner(t *testing.T) {
+	l := NewConsensusMessageLog()
+	digest := []byte("block-digest")
+	vote := signedVote(t, 1, digest)
+
+	added, err := l.Add(vote)
+	if err != nil {
+		t.Fatalf("unexpected error on first Add: %s", err)
+	}
+	if !added {
+		t.Fatal("expected first vote from a signer to be added")
+	}
+
+	added, err = l.Add(vote)
+	if err != nil {
+		t.Fatalf("unexpected error on duplicate Add: %s", err)
+	}
+	if added {
+		t.Fatal("expected duplicate vote from the same signer to be rejected")
+	}
+	if got := l.Count(1, digest, COMMIT); got != 1 {
+		t.Fatalf("Count = %d, want 1 after a duplicate vote", got)
+	}
+}
+
+func TestConsensusMessageLog_AddRejectsInvalidSignature(t *testing.T) {
+	l := NewConsensusMessageLog()
+	vote := signedVote(t, 1, []byte("block-digest"))
+	vote.Signature = []byte("not-a-real-signature")
+
+	added, err := l.Add(vote)
+	if err == nil {
+		t.Fatal("expected an error for an invalid signature")
+	}
+	if added {
+		t.Fatal("expected a vote with an invalid signature to be rejected")
+	}
+}
+
+func TestConsensusMessageLog_CountOnlyCountsUniqueSigners(t *testing.T) {
+	l := NewConsensusMessageLog()
+	digest := []byte("block-digest")
+
+	const n = 4
+	for i := 0; i < n; i++ {
+		vote := signedVote(t, 7, digest)
+		if _, err := l.Add(vote); err != nil {
+			t.Fatalf("unexpected error adding vote %d: %s", i, err)
+		}
+	}
+
+	if got := l.Count(7, digest, COMMIT); got != n {
+		t.Fatalf("Count = %d, want %d", got, n)
+	}
+	if got := l.Count(7, []byte("other-digest"), COMMIT); got != 0 {
+		t.Fatalf("Count for unrelated digest = %d, want 0", got)
+	}
+	if got := l.Count(7, digest, PRE_COMMIT); got != 0 {
+		t.Fatalf("Count for unrelated type = %d, want 0", got)
+	}
+
+	if got := len(l.Signatures(7, digest, COMMIT)); got != n {
+		t.Fatalf("Signatures returned %d entries, want %d", got, n)
+	}
+}
@@ -0,0 +1,160 @@
+package dpos_bft
+
+import (
+	"sync"
+
+	msg "tinychain/consensus/dpos_bft/message"
+)
+
+// RoundPhase marks the progress a single consensus round has made through
+// the PRE_PREPARE -> PRE_COMMIT -> COMMIT pipeline.
+type RoundPhase int
+
+const (
+	PhasePrePrepare RoundPhase = iota
+	PhasePreCommit
+	PhaseCommit
+	PhaseCommitted
+)
+
+// ConsensusState tracks the phase and view a single round (SeqNo) has
+// reached, so two rounds in flight at once never clobber each other and a
+// message for a round that has already committed, or a view that has
+// already been abandoned, is never mistaken for the current one. Vote
+// counting itself is delegated to the engine's ConsensusMessageLog, which
+// dedupes by signer rather than by round phase.
+type ConsensusState struct {
+	mu sync.Mutex
+
+	SeqNo         uint64
+	View          uint64
+	Phase         RoundPhase
+	PrePrepareMsg *msg.ConsensusMsg
+}
+
+func newConsensusState(seqNo uint64) *ConsensusState {
+	return &ConsensusState{
+		SeqNo: seqNo,
+		Phase: PhasePrePrepare,
+	}
+}
+
+// setPrePrepare records the round's PRE_PREPARE and advances the phase.
+// Returns false if a PRE_PREPARE has already been set for this view.
+func (s *ConsensusState) setPrePrepare(message *msg.ConsensusMsg) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.PrePrepareMsg != nil {
+		return false
+	}
+	s.PrePrepareMsg = message
+	s.Phase = PhasePreCommit
+	return true
+}
+
+// advance moves the round to phase if it hasn't reached it yet, returning
+// true the first time phase is reached so callers can fire a transition
+// exactly once.
+func (s *ConsensusState) advance(phase RoundPhase) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Phase >= phase {
+		return false
+	}
+	s.Phase = phase
+	return true
+}
+
+// rotateView abandons the round's current view and starts newView fresh:
+// PrePrepareMsg is cleared so a NEW_VIEW's PRE_PREPARE can be accepted,
+// and the phase resets to PhasePrePrepare so stale PRE_COMMIT/COMMIT
+// messages addressed to the old view are rejected by matchesView.
+// Returns false if newView is not actually newer than the round's
+// current view.
+func (s *ConsensusState) rotateView(newView uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if newView <= s.View {
+		return false
+	}
+	s.View = newView
+	s.Phase = PhasePrePrepare
+	s.PrePrepareMsg = nil
+	return true
+}
+
+// matchesView reports whether view is the round's current view. Messages
+// for a view that has since been rotated away from are stale.
+func (s *ConsensusState) matchesView(view uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.View == view
+}
+
+// phase returns the round's current phase.
+func (s *ConsensusState) phase() RoundPhase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Phase
+}
+
+// lastPreparedDigest returns the digest of the last PRE_PREPARE this node
+// accepted for the round, or nil if none has been accepted yet. It is
+// carried in this node's VIEW_CHANGE message so the newly elected BP can
+// tell whether a block was already close to committing.
+func (s *ConsensusState) lastPreparedDigest() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.PrePrepareMsg == nil {
+		return nil
+	}
+	return s.PrePrepareMsg.Digest
+}
+
+// ConsensusStatePool keeps one ConsensusState per in-flight round, keyed by
+// SeqNo, so rounds can be processed concurrently without their votes
+// clobbering each other and so messages belonging to a round that already
+// committed can be recognized and discarded.
+type ConsensusStatePool struct {
+	mu     sync.RWMutex
+	states map[uint64]*ConsensusState
+}
+
+// NewConsensusStatePool creates an empty pool.
+func NewConsensusStatePool() *ConsensusStatePool {
+	return &ConsensusStatePool{
+		states: make(map[uint64]*ConsensusState),
+	}
+}
+
+// getOrCreate returns the state for seqNo, creating it if this is the first
+// message seen for that round.
+func (p *ConsensusStatePool) getOrCreate(seqNo uint64) *ConsensusState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.states[seqNo]
+	if !ok {
+		state = newConsensusState(seqNo)
+		p.states[seqNo] = state
+	}
+	return state
+}
+
+// get returns the state for seqNo if a round has already been started for
+// it. The bool is false when no state exists for seqNo (nothing has called
+// getOrCreate for it, or it has been pruned), which lets callers discard
+// late messages for a round that has been pruned. A state created by
+// ExpectRound or viewChange is returned even before any PRE_PREPARE.
+func (p *ConsensusStatePool) get(seqNo uint64) (*ConsensusState, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	state, ok := p.states[seqNo]
+	return state, ok
+}
+
+// delete prunes the state for seqNo, e.g. once the round has committed.
+func (p *ConsensusStatePool) delete(seqNo uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.states, seqNo)
+}
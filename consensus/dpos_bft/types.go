@@ -0,0 +1,15 @@
+package dpos_bft
+
+import (
+	msg "tinychain/consensus/dpos_bft/message"
+)
+
+// Phase aliases re-export the wire-level message types so the rest of the
+// package can refer to them without the msg. qualifier.
+const (
+	PRE_PREPARE = msg.MsgType_PRE_PREPARE
+	PRE_COMMIT  = msg.MsgType_PRE_COMMIT
+	COMMIT      = msg.MsgType_COMMIT
+	VIEW_CHANGE = msg.MsgType_VIEW_CHANGE
+	NEW_VIEW    = msg.MsgType_NEW_VIEW
+)
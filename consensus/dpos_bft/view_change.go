@@ -0,0 +1,268 @@
+package dpos_bft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p-crypto"
+	"github.com/libp2p/go-libp2p-peer"
+	"tinychain/common"
+	msg "tinychain/consensus/dpos_bft/message"
+)
+
+var (
+	errNotNextBP          = errors.New("local node is not the next BP for this view")
+	errViewChangeNotReady = errors.New("view change has not reached quorum yet")
+
+	// viewChangeTimeout is how long a round may sit without reaching
+	// PhaseCommit before the local node gives up on the current
+	// leader/view and requests a change.
+	viewChangeTimeout = 10 * time.Second
+)
+
+// ExpectRound arms seqNo's view-change timer before any PRE_PREPARE has
+// necessarily been seen, so a leader that never proposes at all is
+// recovered from exactly like one that proposes but stalls. It also
+// resolves any fork left over from the previous height before the new
+// round's BP starts building on top of it. Whatever schedules the
+// engine's rounds should call this once per SeqNo, for every
+// participant, not just the BP.
+func (eg *Engine) ExpectRound(seqNo uint64) {
+	if seqNo > 0 {
+		if err := eg.PruneAcceptedBlocks(seqNo - 1); err != nil {
+			log.Errorf("failed to prune accepted blocks for round #%d, err:%s", seqNo-1, err)
+		}
+	}
+	eg.statePool.getOrCreate(seqNo)
+	eg.watchRound(seqNo, 0)
+}
+
+// watchRound arms a timer for (seqNo, view); if the round has not reached
+// PhaseCommit (i.e. collected >=2/3 PRE_COMMITs) before viewChangeTimeout
+// elapses, it requests a view change instead of leaving the round
+// stalled on a slow or byzantine leader forever.
+func (eg *Engine) watchRound(seqNo, view uint64) {
+	timer := time.NewTimer(viewChangeTimeout)
+	go func() {
+		<-timer.C
+		state, ok := eg.statePool.get(seqNo)
+		if !ok || !state.matchesView(view) || state.phase() >= PhaseCommit {
+			return
+		}
+		if err := eg.viewChange(seqNo, view+1); err != nil {
+			log.Errorf("failed to request view change for round #%d view %d, err:%s", seqNo, view, err)
+		}
+	}()
+}
+
+// viewChange multicasts a VIEW_CHANGE requesting the round move to
+// newView, carrying the digest of whatever this node last prepared (if
+// anything) so the newly elected BP can tell how close the round already
+// was to committing.
+func (eg *Engine) viewChange(seqNo, newView uint64) error {
+	state := eg.statePool.getOrCreate(seqNo)
+	lastPrepared := state.lastPreparedDigest()
+
+	sign, err := eg.Self().PrivKey().Sign(viewChangeDigest(seqNo, newView))
+	if err != nil {
+		log.Errorf("failed to sign VIEW_CHANGE message, err:%s", err)
+		return err
+	}
+	pubKey, err := eg.Self().PubKey().Bytes()
+	if err != nil {
+		log.Errorf("failed to convert pubkey to bytes, err:%s", err)
+		return err
+	}
+
+	return eg.multicastConsensus(&msg.ConsensusMsg{
+		Type:         VIEW_CHANGE,
+		SeqNo:        seqNo,
+		NewView:      newView,
+		LastPrepared: lastPrepared,
+		Digest:       viewChangeDigest(seqNo, newView),
+		PubKey:       pubKey,
+		Signature:    sign,
+	})
+}
+
+// handleViewChange records a VIEW_CHANGE vote and, once >=2/3 unique BPs
+// have requested the same (seqNo, newView), checks whether the local node
+// is the deterministically elected next BP for newView. Only that node
+// rotates the round to newView immediately and issues NEW_VIEW with the
+// aggregated view-change certificate and a fresh PRE_PREPARE - every other
+// node leaves the round's view untouched here and rotates only when
+// NEW_VIEW's own PRE_PREPARE arrives (see handleNewView). Rotating early
+// for followers would set state.View = newView before that point, and
+// since rotateView only succeeds on a strictly greater view
+// (state_pool.go), handleNewView's own rotateView call would then find
+// the view already current, return false, and never invoke
+// acceptPrePrepare - deadlocking the round right after its first view
+// change.
+func (eg *Engine) handleViewChange(pid peer.ID, message *msg.ConsensusMsg) error {
+	if _, err := eg.msgLog.Add(message); err != nil {
+		log.Errorf("failed to record VIEW_CHANGE vote, err:%s", err)
+		return err
+	}
+
+	count := eg.msgLog.Count(message.SeqNo, message.Digest, VIEW_CHANGE)
+	if count <= eg.config.RoundSize*2/3 {
+		return nil
+	}
+
+	bps := eg.bps.getBPs()
+	if len(bps) == 0 {
+		return errNotNextBP
+	}
+	nextBP := bps[message.NewView%uint64(len(bps))]
+
+	selfPubKey, err := eg.Self().PubKey().Bytes()
+	if err != nil {
+		log.Errorf("failed to convert pubkey to bytes, err:%s", err)
+		return err
+	}
+	if bytes.Compare(nextBP.pubKey, selfPubKey) != 0 {
+		return nil
+	}
+
+	state := eg.statePool.getOrCreate(message.SeqNo)
+	if !state.rotateView(message.NewView) {
+		return nil
+	}
+	eg.watchRound(message.SeqNo, message.NewView)
+
+	cert := eg.msgLog.Signatures(message.SeqNo, message.Digest, VIEW_CHANGE)
+	return eg.issueNewView(message.SeqNo, message.NewView, cert)
+}
+
+// issueNewView is called by the deterministically elected next BP once a
+// view change has reached quorum: it attaches its own election proof and
+// winCount for seqNo (the seed does not include newView, and a winCount
+// of 0 is sent as is) and multicasts NEW_VIEW carrying both the
+// view-change certificate and the new PRE_PREPARE.
+func (eg *Engine) issueNewView(seqNo, newView uint64, cert []*msg.ConsensusMsg) error {
+	block, err := eg.fetchBlockLoop(seqNo)
+	if err != nil {
+		return err
+	}
+
+	beaconEntry, err := eg.beacon.EntryForHeight(seqNo)
+	if err != nil {
+		log.Errorf("failed to fetch beacon entry for round #%d, err:%s", seqNo, err)
+		return err
+	}
+
+	electionProof, err := computeElectionProof(eg.Self().PrivKey(), beaconEntry.Data, seqNo)
+	if err != nil {
+		return err
+	}
+	selfPubKey, err := eg.Self().PubKey().Bytes()
+	if err != nil {
+		return err
+	}
+	winCount := computeWinCount(electionProof, eg.stakeOf(selfPubKey), eg.totalStake())
+
+	digest, pubKey, sign, err := eg.computeConsensusInfo(block)
+	if err != nil {
+		return err
+	}
+
+	state := eg.statePool.getOrCreate(seqNo)
+	newViewMsg := &msg.ConsensusMsg{
+		Type:           NEW_VIEW,
+		SeqNo:          seqNo,
+		View:           newView,
+		Digest:         digest,
+		PubKey:         pubKey,
+		Signature:      sign,
+		Header:         block.Header().Bytes(),
+		BeaconRound:    beaconEntry.Round,
+		ElectionProof:  electionProof,
+		WinCount:       winCount,
+		ViewChangeCert: cert,
+	}
+	if !state.setPrePrepare(newViewMsg) {
+		return errPrePrepareExist
+	}
+
+	return eg.multicastConsensus(newViewMsg)
+}
+
+// handleNewView accepts a NEW_VIEW once its view-change certificate
+// carries >=2/3 unique VIEW_CHANGE votes for (seqNo, newView) and its
+// embedded PRE_PREPARE checks out, then proceeds exactly like a PRE_PREPARE
+// for the rotated view. The embedded PRE_PREPARE is accepted without
+// re-running checkElection: the next BP for a NEW_VIEW is chosen by
+// deterministic round-robin (see handleViewChange), not by winning the
+// round's VRF sortition, so its legitimacy rests entirely on the
+// view-change quorum verified here.
+func (eg *Engine) handleNewView(pid peer.ID, message *msg.ConsensusMsg) error {
+	voters, err := eg.verifyViewChangeCert(message.SeqNo, message.View, message.ViewChangeCert)
+	if err != nil {
+		log.Errorf("failed to verify NEW_VIEW's view-change cert, err:%s", err)
+		return err
+	}
+	if voters <= eg.config.RoundSize*2/3 {
+		return errViewChangeNotReady
+	}
+
+	state := eg.statePool.getOrCreate(message.SeqNo)
+	if !state.rotateView(message.View) {
+		return nil
+	}
+
+	return eg.acceptPrePrepare(pid, message)
+}
+
+// verifyViewChangeCert checks that cert is a set of VIEW_CHANGE votes that
+// actually supports (seqNo, newView): every entry must carry a valid
+// signature over viewChangeDigest(seqNo, newView) from the claimed PubKey.
+// It returns the number of unique signers, counted by peer.ID rather than
+// by len(cert), so a next-BP cannot manufacture quorum by padding the
+// certificate with duplicate or fabricated entries - the same dedup
+// philosophy ConsensusMessageLog applies to live votes.
+func (eg *Engine) verifyViewChangeCert(seqNo, newView uint64, cert []*msg.ConsensusMsg) (int, error) {
+	digest := viewChangeDigest(seqNo, newView)
+	voters := make(map[peer.ID]bool)
+	for _, vc := range cert {
+		if vc.Type != VIEW_CHANGE || vc.SeqNo != seqNo || vc.NewView != newView {
+			return 0, errDigestNotMatch
+		}
+		if bytes.Compare(vc.Digest, digest) != 0 {
+			return 0, errDigestNotMatch
+		}
+
+		pubKey, err := crypto.UnmarshalPublicKey(vc.PubKey)
+		if err != nil {
+			log.Errorf("invalid public key in view-change cert, err:%s", err)
+			return 0, err
+		}
+		equal, err := pubKey.Verify(vc.Digest, vc.Signature)
+		if err != nil {
+			log.Errorf("error occurs when verify view-change signature, err:%s", err)
+			return 0, err
+		}
+		if !equal {
+			return 0, errSignatureInvalid
+		}
+
+		id, err := peer.IDFromPublicKey(pubKey)
+		if err != nil {
+			log.Errorf("failed to derive peer ID from public key, err:%s", err)
+			return 0, err
+		}
+		voters[id] = true
+	}
+	return len(voters), nil
+}
+
+// viewChangeDigest derives the digest VIEW_CHANGE votes for (seqNo,
+// newView) are signed and grouped under, since a view change has no
+// block digest of its own to vote on.
+func viewChangeDigest(seqNo, newView uint64) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], seqNo)
+	binary.BigEndian.PutUint64(buf[8:], newView)
+	return common.Sha256(buf).Bytes()
+}